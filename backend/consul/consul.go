@@ -0,0 +1,270 @@
+// Package consul implements elector.Backend on top of Consul's KV store.
+// Leadership is arbitrated with a Consul session lock, so that a lost
+// connection or a node crash reliably frees the key via the session's TTL
+// instead of relying on wall clock comparisons between peers.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afiskon/go-elector"
+)
+
+// Consul KV response in the JSON format.
+type consulResponse struct {
+	LockIndex   uint64
+	Key         string
+	Flags       uint64
+	Value       string
+	Session     string
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// Backend is a Consul backed implementation of elector.Backend. kvUrl should
+// point at a single Consul KV key, e.g. "http://127.0.0.1:8500/v1/kv/myapp/leader".
+//
+// A Backend is stateful (it holds on to the Consul session it creates) and
+// is meant to be used by a single elector instance. That instance still
+// calls into it from two separate goroutines (the State Updater's renewal
+// loop and the State Keeper's handling of TransferLeadership), so mu guards
+// every access to sessionID.
+type Backend struct {
+	kvUrl      string
+	sessionTTL time.Duration
+	lockDelay  time.Duration
+	metrics    elector.Metrics
+
+	mu          sync.Mutex
+	client      httpClient
+	sessionID   string
+	skippedHint string // handoff hint AcquireOrRenew already sat a round out for
+}
+
+// New creates a Consul backend that stores leadership information under
+// kvUrl using a Consul session. sessionTTL is how long Consul waits without a
+// renewal before it considers the session (and thus the lock) dead; lockDelay
+// is the extra grace period Consul enforces before anyone else is allowed to
+// acquire the key after that. metrics may be nil, in which case events are discarded.
+func New(kvUrl string, sessionTTL, lockDelay time.Duration, metrics elector.Metrics) *Backend {
+	if metrics == nil {
+		metrics = elector.NopMetrics{}
+	}
+	return &Backend{kvUrl: kvUrl, sessionTTL: sessionTTL, lockDelay: lockDelay, metrics: metrics}
+}
+
+// http.Client wrapper for adding new methods, particularly sendReq.
+type httpClient struct {
+	parent http.Client
+}
+
+// A bit more convenient method for sending HTTP requests
+func (client *httpClient) sendReq(ctx context.Context, method, url string, reqBody []byte) (resp *http.Response, resBody []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err = client.parent.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	resBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, resBody, nil
+}
+
+// agentUrl turns the KV endpoint this Backend was created with into the base
+// URL of the Consul agent serving it, e.g. "http://127.0.0.1:8500".
+func (b *Backend) agentUrl() string {
+	if idx := strings.Index(b.kvUrl, "/v1/kv/"); idx >= 0 {
+		return b.kvUrl[:idx]
+	}
+	return b.kvUrl
+}
+
+// AcquireOrRenew renews this backend's Consul session, then either confirms
+// the lock it already holds, finds out who else holds it, races to acquire
+// it if it is currently free, or - if a TransferLeadership call left a hint
+// naming a different node - sits the round out to give that node first shot.
+func (b *Backend) AcquireOrRenew(ctx context.Context, selfId string, hold time.Duration) (leaderId string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sessionID == "" {
+		if err := b.createSession(ctx); err != nil {
+			return "", err
+		}
+	} else if err := b.renewSession(ctx); err != nil {
+		return "", err
+	}
+
+	value, session, err := b.readRaw(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if session != "" {
+		// either we already hold the lock, or someone else does and their
+		// session is still alive - nothing to acquire either way
+		b.skippedHint = ""
+		return value, nil
+	}
+
+	if value != "" && value != selfId && value != b.skippedHint {
+		// a handoff hint names someone else, give them one round to claim it first
+		b.skippedHint = value
+		return "", nil
+	}
+
+	url := b.kvUrl + "?acquire=" + b.sessionID
+	resp, body, err := b.client.sendReq(ctx, http.MethodPut, url, []byte(selfId))
+	if err != nil {
+		return "", fmt.Errorf("PUT '%s' failed: '%s'", url, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		b.metrics.HTTPError(resp.StatusCode)
+		return "", fmt.Errorf("Unexpected HTTP status code (expected 200): %s", resp.Status)
+	}
+
+	if string(body) != "true" {
+		// somebody else won the race, or the key is still under lock delay
+		b.metrics.CASConflict()
+		return "", nil
+	}
+
+	return selfId, nil
+}
+
+// Release gives up the lock held by this backend's session ahead of its TTL,
+// if any; it is a no-op if the backend never acquired a session. If targetId
+// is non-empty it is written as the key's new value in the same request, so
+// that the next AcquireOrRenew call from any node recognises it as a handoff
+// hint and lets targetId go first.
+func (b *Backend) Release(ctx context.Context, targetId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sessionID == "" {
+		return nil
+	}
+
+	url := b.kvUrl + "?release=" + b.sessionID
+	resp, _, err := b.client.sendReq(ctx, http.MethodPut, url, []byte(targetId))
+	if err != nil {
+		return fmt.Errorf("PUT '%s' failed: '%s'", url, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		b.metrics.HTTPError(resp.StatusCode)
+		return fmt.Errorf("Unexpected HTTP status code (expected 200): %s", resp.Status)
+	}
+
+	b.sessionID = ""
+	return nil
+}
+
+// createSession creates a new Consul session backing this backend's lock,
+// with Behavior "delete" so that the key is deleted the instant the session
+// is destroyed, rather than merely unlocked.
+func (b *Backend) createSession(ctx context.Context) error {
+	payload, _ := json.Marshal(struct {
+		TTL       string
+		LockDelay string
+		Behavior  string
+	}{
+		TTL:       b.sessionTTL.String(),
+		LockDelay: b.lockDelay.String(),
+		Behavior:  "delete",
+	})
+
+	url := b.agentUrl() + "/v1/session/create"
+	resp, body, err := b.client.sendReq(ctx, http.MethodPut, url, payload)
+	if err != nil {
+		return fmt.Errorf("PUT '%s' failed: '%s'", url, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		b.metrics.HTTPError(resp.StatusCode)
+		return fmt.Errorf("Unexpected HTTP status code (expected 200): %s", resp.Status)
+	}
+
+	var session struct{ ID string }
+	if err := json.Unmarshal(body, &session); err != nil {
+		return fmt.Errorf("Failed to unmarshal session response '%s', error: %s", body, err.Error())
+	}
+
+	b.sessionID = session.ID
+	return nil
+}
+
+// renewSession keeps this backend's Consul session alive. A failed renewal
+// (including a 404, meaning Consul already destroyed the session and thus
+// released the lock) is treated as an immediate loss of the session.
+func (b *Backend) renewSession(ctx context.Context) error {
+	url := b.agentUrl() + "/v1/session/renew/" + b.sessionID
+	resp, _, err := b.client.sendReq(ctx, http.MethodPut, url, nil)
+	if err != nil {
+		b.sessionID = ""
+		return fmt.Errorf("PUT '%s' failed: '%s'", url, err.Error())
+	}
+
+	if resp.StatusCode != 200 {
+		b.sessionID = ""
+		b.metrics.HTTPError(resp.StatusCode)
+		return fmt.Errorf("Unexpected HTTP status code (expected 200) while renewing session: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// readRaw fetches the key's current value and the session currently holding
+// the lock on it (if any). It returns value even when the key isn't locked,
+// since AcquireOrRenew needs it to recognise handoff hints.
+func (b *Backend) readRaw(ctx context.Context) (value, session string, err error) {
+	resp, body, err := b.client.sendReq(ctx, http.MethodGet, b.kvUrl, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("GET '%s' failed: '%s'", b.kvUrl, err.Error())
+	}
+
+	if resp.StatusCode == 404 {
+		return "", "", nil
+	}
+	if resp.StatusCode != 200 {
+		b.metrics.HTTPError(resp.StatusCode)
+		return "", "", fmt.Errorf("Unexpected HTTP status code (expected 200 or 404): %s", resp.Status)
+	}
+
+	return decodeConsulResponse(body)
+}
+
+// decodeConsulResponse unwraps Consul's KV response envelope, returning the
+// base64-decoded value and the session currently holding the lock, if any.
+func decodeConsulResponse(body []byte) (value, session string, err error) {
+	var consulRespArr []consulResponse
+	err = json.Unmarshal(body, &consulRespArr)
+	if (err != nil) || len(consulRespArr) != 1 {
+		return "", "", fmt.Errorf("Failed to unmarshal Consul response '%s', error: %s", body, err)
+	}
+
+	consulResp := consulRespArr[0]
+
+	decoded, err := base64.StdEncoding.DecodeString(consulResp.Value)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to decode base64 value '%s', error: %s", consulResp.Value, err.Error())
+	}
+
+	return string(decoded), consulResp.Session, nil
+}
@@ -0,0 +1,109 @@
+// Package etcd implements elector.Backend on top of etcd v3, using a lease
+// to expire stale leadership and a transactional campaign to arbitrate it.
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/afiskon/go-elector"
+)
+
+// Backend is an etcd v3 backed implementation of elector.Backend. All nodes
+// participating in the same election must agree on key.
+//
+// A Backend is meant to be used by a single elector instance. That instance
+// still calls into it from two separate goroutines (the State Updater's
+// renewal loop and the State Keeper's handling of TransferLeadership), so mu
+// guards every access to leaseID.
+type Backend struct {
+	client  *clientv3.Client
+	key     string
+	metrics elector.Metrics
+
+	mu      sync.Mutex
+	leaseID clientv3.LeaseID
+}
+
+// New creates an etcd backend that stores leadership under key, using client
+// to talk to the cluster. metrics may be nil, in which case events are discarded.
+func New(client *clientv3.Client, key string, metrics elector.Metrics) *Backend {
+	if metrics == nil {
+		metrics = elector.NopMetrics{}
+	}
+	return &Backend{client: client, key: key, metrics: metrics}
+}
+
+// AcquireOrRenew grants (or renews) a lease tied to hold and campaigns for
+// the key with a transaction that only succeeds if nobody holds it yet.
+func (b *Backend) AcquireOrRenew(ctx context.Context, selfId string, hold time.Duration) (leaderId string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.leaseID == 0 {
+		// round up so a sub-second hold (e.g. in tests, or a fast-failover
+		// config) doesn't truncate to an invalid zero-second TTL
+		lease, err := b.client.Grant(ctx, int64(math.Ceil(hold.Seconds())))
+		if err != nil {
+			return "", fmt.Errorf("etcd Grant failed: %s", err.Error())
+		}
+		b.leaseID = lease.ID
+	} else if _, err := b.client.KeepAliveOnce(ctx, b.leaseID); err != nil {
+		// the lease expired or is otherwise gone, start over on the next call
+		b.leaseID = 0
+		return "", fmt.Errorf("etcd KeepAliveOnce failed: %s", err.Error())
+	}
+
+	txn := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(b.key), "=", 0)).
+		Then(clientv3.OpPut(b.key, selfId, clientv3.WithLease(b.leaseID))).
+		Else(clientv3.OpGet(b.key))
+
+	resp, err := txn.Commit()
+	if err != nil {
+		return "", fmt.Errorf("etcd Txn failed: %s", err.Error())
+	}
+
+	if resp.Succeeded {
+		return selfId, nil
+	}
+
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		// the key disappeared between the If and the Else branches, retry next time
+		return "", nil
+	}
+
+	leaderId = string(kvs[0].Value)
+	if leaderId != selfId {
+		// someone else holds the key; if it's us, the If branch only failed
+		// because we're just confirming the lease we already hold
+		b.metrics.CASConflict()
+	}
+	return leaderId, nil
+}
+
+// Release revokes the lease backing this backend's leadership, if any,
+// deleting the key and letting any peer race for it on their next poll. etcd
+// has no notion of a directed handoff without a separate negotiation between
+// nodes, so targetId is accepted for interface compatibility but otherwise ignored.
+func (b *Backend) Release(ctx context.Context, targetId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.leaseID == 0 {
+		return nil
+	}
+
+	if _, err := b.client.Revoke(ctx, b.leaseID); err != nil {
+		return fmt.Errorf("etcd Revoke failed: %s", err.Error())
+	}
+
+	b.leaseID = 0
+	return nil
+}
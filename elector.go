@@ -1,16 +1,14 @@
-// Leader election based on the leader lease approach. Requires Consul.
+// Leader election based on the leader lease approach.
+// Leadership state is persisted through a pluggable Backend, see the
+// backend/consul and backend/etcd subpackages for ready to use implementations.
 package elector
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"net/http"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -27,12 +25,16 @@ const (
 	// Leader was changed
 	tUPDATELEADER
 
-	// Terminate the elector
-	// TERMINATE // TODO implement
+	// Voluntarily transfer leadership to another node
+	tTRANSFER
 )
 
-// Type of function called when leader changes.
-type Callback func(oldLeaderId string, newLeaderId string)
+// Type of function called when leader changes. ctx is cancelled after
+// electorConfig.callbackTimeout; a callback that returns once ctx is done
+// doesn't stall the State Keeper process (which also serves
+// GetCurrentLeader) indefinitely, one that ignores ctx does. A returned
+// error is logged but otherwise doesn't affect the elector.
+type Callback func(ctx context.Context, oldLeaderId string, newLeaderId string) error
 
 // Representation of requests sent to the State Keeper process
 type request struct {
@@ -47,232 +49,406 @@ type request struct {
 
 	// tUPDATELEADER: new leader id (can be '')
 	newLeaderId string
+
+	// tTRANSFER: node leadership should be handed off to
+	targetId string
+
+	// tTRANSFER: where to send the outcome of attempting the handoff
+	errch chan<- error
 }
 
 // Representation of the elector instance.
 // This type is exported only for better docs, could have kept private.
 type Instance struct {
-	reqch chan<- request
+	reqch  chan<- request
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-// JSON description of the current leader.
-type leaderInfo struct {
-	LeaderId   string
-	UpdateTime time.Time
+// Backend persists and observes leadership on behalf of the elector. It is
+// the only piece of the elector that talks to an external store, which makes
+// it possible to plug in anything that supports a CAS-like primitive:
+// backend/consul and backend/etcd are shipped out of the box.
+//
+// A single Instance calls into its Backend from two goroutines (the State
+// Updater's renewal loop and the State Keeper's handling of
+// TransferLeadership), so implementations must be safe for that level of
+// concurrent use; backend/consul and backend/etcd do this with a mutex.
+type Backend interface {
+	// AcquireOrRenew tries to make selfId the leader, or to renew its lease
+	// if selfId is already the leader. hold is how long the caller intends
+	// to hold leadership for before the next renewal. It returns the id of
+	// whoever ends up holding leadership once the call returns, which may
+	// not be selfId if another node won the race or is still within its lease.
+	AcquireOrRenew(ctx context.Context, selfId string, hold time.Duration) (leaderId string, err error)
+
+	// Release voluntarily gives up the leadership held by whoever called it,
+	// ahead of the lease's normal expiry. If targetId is non-empty,
+	// implementations that can express a preference may leave a hint so that
+	// node wins the next election; backends that can't simply give up the
+	// lock for anyone to race for.
+	Release(ctx context.Context, targetId string) error
 }
 
-// Consul KV response in the JSON format.
-type consulResponse struct {
-	LockIndex   uint64
-	Key         string
-	Flags       uint64
-	Value       string
-	CreateIndex uint64
-	ModifyIndex uint64
-}
+// Metrics receives instrumentation events from the elector and its Backend.
+// A default Prometheus-backed implementation is available in
+// metrics/prometheus; NopMetrics is used when none is configured.
+type Metrics interface {
+	// LeaderTransition is called whenever the known leader changes,
+	// including transitions to and from '' (no leader).
+	LeaderTransition(oldLeaderId, newLeaderId string)
 
-// Elector configuration paramteres.
-type electorConfig struct {
-	selfId         string
-	consulUrl      string
-	leaderHoldTime time.Duration
-}
+	// CASConflict is called whenever a backend's compare-and-swap style
+	// write loses a race to another node.
+	CASConflict()
 
-// http.Client wrapper for adding new methods, particularly sendReq.
-type httpClient struct {
-	parent http.Client
-}
+	// HTTPError is called after an HTTP round trip to the backend that
+	// returned an unexpected status code.
+	HTTPError(statusCode int)
 
-// A bit more convenient method for sending HTTP requests
-func (client *httpClient) sendReq(method, url string, reqBody []byte) (resp *http.Response, resBody []byte, err error) {
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return nil, nil, err
-	}
+	// RenewLatency records how long a single AcquireOrRenew call took.
+	RenewLatency(d time.Duration)
 
-	resp, err = client.parent.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
-
-	resBody, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return resp, resBody, nil
+	// IsLeader reports whether selfId currently believes it holds
+	// leadership, e.g. for an is_leader{self_id=...} gauge.
+	IsLeader(selfId string, isLeader bool)
 }
 
-// Determine current leader or elect a new one using the leader lease approach.
-func getCurrentLeader(conf *electorConfig) (leaderId string, err error) {
-	for {
-		var repeat bool
-		leaderId, repeat, err = getCurrentLeaderInternal(conf)
-		if !repeat {
-			break
-		}
-	}
-	return
-}
+// NopMetrics is a Metrics implementation that discards every event. It is
+// the default when no Metrics is configured via WithMetrics.
+type NopMetrics struct{}
 
-// For internal usage in getCurrentLeader function only.
-func getCurrentLeaderInternal(conf *electorConfig) (leaderId string, repeat bool, err error) {
-	client := httpClient{}
-	resp, body, err := client.sendReq(http.MethodGet, conf.consulUrl, nil)
-	if err != nil {
-		err := fmt.Errorf("GET '%s' failed: '%s'", conf.consulUrl, err.Error())
-		return "", false, err
-	}
+func (NopMetrics) LeaderTransition(oldLeaderId, newLeaderId string) {}
+func (NopMetrics) CASConflict()                                     {}
+func (NopMetrics) HTTPError(statusCode int)                         {}
+func (NopMetrics) RenewLatency(d time.Duration)                     {}
+func (NopMetrics) IsLeader(selfId string, isLeader bool)            {}
 
-	var update bool
-	var cas uint64
-
-	switch {
-	case resp.StatusCode == 404:
-		// there is no leader yet
-		update = true
-	case resp.StatusCode != 200:
-		err := fmt.Errorf("Unexpected HTTP status code (expected 200 or 404): %s", resp.Status)
-		return "", false, err
-	default: // it's 200
-		var consulRespArr []consulResponse
-		err = json.Unmarshal(body, &consulRespArr)
-		if (err != nil) || len(consulRespArr) != 1 {
-			err := fmt.Errorf("Failed to unmarshal Consul response '%s', error: %s", body, err.Error())
-			return "", false, err
-		}
+// RenewBehavior controls how the State Updater process reacts to a failed
+// renewal while this node is the current leader.
+type RenewBehavior int
 
-		consulResp := consulRespArr[0]
+const (
+	// ErrorOnFail surrenders leadership as soon as a single renewal fails.
+	ErrorOnFail RenewBehavior = iota
 
-		cas = consulResp.ModifyIndex
-		jinfo, err := base64.StdEncoding.DecodeString(consulResp.Value)
-		if err != nil {
-			err := fmt.Errorf("Failed to decode base64 value '%s', error: %s", consulResp.Value, err.Error())
-			return "", false, err
-		}
+	// IgnoreTransient keeps renewing through backend errors for up to
+	// RenewGrace before surrendering leadership.
+	IgnoreTransient
+)
 
-		var leaderInfo leaderInfo
-		err = json.Unmarshal(jinfo, &leaderInfo)
-		if err != nil {
-			err := fmt.Errorf("Failed to decode leader info '%s', error: %s", jinfo, err.Error())
-			return "", false, err
-		}
+// Elector configuration paramteres.
+type electorConfig struct {
+	selfId          string
+	backend         Backend
+	leaderHoldTime  time.Duration
+	renewInterval   time.Duration
+	renewGrace      time.Duration
+	renewBehavior   RenewBehavior
+	metrics         Metrics
+	callbackTimeout time.Duration
+}
 
-		leaderId = leaderInfo.LeaderId
-		if leaderId == conf.selfId {
-			// leader always updates it's info
-			update = true
-		} else {
-			// is it time to select a new leader?
-			passed := time.Now().Sub(leaderInfo.UpdateTime)
-			update = passed > conf.leaderHoldTime
-		}
-	}
+// Option overrides one of the elector's optional parameters. See
+// WithRenewInterval, WithRenewGrace and WithRenewBehavior.
+type Option func(*electorConfig)
 
-	if !update {
-		return leaderId, false, nil
-	}
+// WithRenewInterval overrides how often a leader renews its lease. Defaults
+// to leaderHoldTime/3.
+func WithRenewInterval(renewInterval time.Duration) Option {
+	return func(conf *electorConfig) { conf.renewInterval = renewInterval }
+}
 
-	info := leaderInfo{LeaderId: conf.selfId, UpdateTime: time.Now().UTC()}
-	payload, _ := json.Marshal(info)
-	url := conf.consulUrl + "?cas=" + strconv.FormatUint(cas, 10)
-	resp, body, err = client.sendReq(http.MethodPut, url, payload)
-	if err != nil {
-		err := fmt.Errorf("PUT '%s' failed: '%s'", url, err.Error())
-		return "", false, err
-	}
+// WithRenewGrace overrides how long a leader keeps retrying through backend
+// errors before surrendering leadership. Only takes effect together with
+// WithRenewBehavior(IgnoreTransient). Defaults to leaderHoldTime minus a
+// small safety margin, so a peer never sees a lease outlast the node that
+// used to hold it.
+func WithRenewGrace(renewGrace time.Duration) Option {
+	return func(conf *electorConfig) { conf.renewGrace = renewGrace }
+}
 
-	if resp.StatusCode != 200 {
-		err := fmt.Errorf("Unexpected HTTP status code (expected 200): %s", resp.Status)
-		return "", false, err
-	}
+// WithRenewBehavior overrides how renewal failures are handled while this
+// node is the leader. Defaults to ErrorOnFail.
+func WithRenewBehavior(renewBehavior RenewBehavior) Option {
+	return func(conf *electorConfig) { conf.renewBehavior = renewBehavior }
+}
 
-	if string(body) != "true" {
-		// CAS failed, repeat all over again
-		return "", true, nil
-	}
+// WithMetrics overrides where the elector reports instrumentation events.
+// Defaults to NopMetrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(conf *electorConfig) { conf.metrics = metrics }
+}
 
-	// CAS succeeded
-	return conf.selfId, false, nil
+// WithCallbackTimeout overrides how long a registered Callback is given to
+// run before its context is cancelled. Defaults to 5 seconds.
+func WithCallbackTimeout(callbackTimeout time.Duration) Option {
+	return func(conf *electorConfig) { conf.callbackTimeout = callbackTimeout }
 }
 
 // Main function of the State Keeper process
-func stateKeeperProc(reqch <-chan request) {
+func stateKeeperProc(ctx context.Context, conf *electorConfig, reqch <-chan request) {
 	leaderId := "" // not elected yet
 	callbacks := []Callback{}
 
 	for {
-		req := <-reqch
-		switch req.typetag {
-		case tGETLEADER: // get current leader
-			req.respch <- leaderId
-		case tUPDATELEADER: // update current leader
-			for i := 0; i < len(callbacks); i++ {
-				callbacks[i](leaderId, req.newLeaderId)
+		select {
+		case <-ctx.Done():
+			if leaderId == conf.selfId {
+				// let callbacks observe the step-down before we go away
+				invokeCallbacks(callbacks, conf.callbackTimeout, leaderId, "")
+				conf.metrics.LeaderTransition(leaderId, "")
+				conf.metrics.IsLeader(conf.selfId, false)
+			}
+			return
+		case req := <-reqch:
+			switch req.typetag {
+			case tGETLEADER: // get current leader
+				req.respch <- leaderId
+			case tUPDATELEADER: // update current leader
+				invokeCallbacks(callbacks, conf.callbackTimeout, leaderId, req.newLeaderId)
+				conf.metrics.LeaderTransition(leaderId, req.newLeaderId)
+				conf.metrics.IsLeader(conf.selfId, req.newLeaderId == conf.selfId)
+				leaderId = req.newLeaderId
+			case tREGCALLBACK: // add a new callback
+				callbacks = append(callbacks, req.callback)
+			case tTRANSFER: // voluntarily hand leadership off to req.targetId
+				if leaderId != conf.selfId {
+					req.errch <- fmt.Errorf("elector: '%s' is not currently the leader", conf.selfId)
+					break
+				}
+				// the State Updater will notice the lost lease on its next
+				// poll and broadcast the resulting tUPDATELEADER itself
+				req.errch <- conf.backend.Release(ctx, req.targetId)
+			default:
+				log.Panicf("State Keeper: unexpected request typetag %d\n", req.typetag)
 			}
-			leaderId = req.newLeaderId
-		case tREGCALLBACK: // add a new callback
-			callbacks = append(callbacks, req.callback)
-		default:
-			log.Panicf("State Keeper: unexpected request typetag %d\n", req.typetag)
 		}
 	}
 }
 
-// Main function of the State Updater process
-func stateUpdaterProc(conf *electorConfig, updch chan<- request) {
-	var err error
+// invokeCallbacks runs every registered callback in turn, each with its own
+// context that is cancelled after timeout. Callbacks run synchronously, so
+// one that ignores its context still blocks the rest, and the State Keeper
+// process that runs them, until it returns.
+func invokeCallbacks(callbacks []Callback, timeout time.Duration, oldLeaderId, newLeaderId string) {
+	for i := 0; i < len(callbacks); i++ {
+		cbCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := callbacks[i](cbCtx, oldLeaderId, newLeaderId)
+		cancel()
+		if err != nil {
+			log.Printf("State Keeper: callback('%s' -> '%s') failed: '%s'\n", oldLeaderId, newLeaderId, err.Error())
+		}
+	}
+}
+
+// Main function of the State Updater process. While this node is not the
+// leader it polls the backend at the usual acquisition cadence; once it
+// becomes the leader it switches to steady-state renewal at RenewInterval,
+// and - if RenewBehavior is IgnoreTransient - keeps renewing through backend
+// errors for up to RenewGrace before surrendering leadership.
+func stateUpdaterProc(ctx context.Context, conf *electorConfig, updch chan<- request) {
 	var lastLeaderId string
+	var failingSince time.Time // zero value means "not currently failing"
 
-	req := request{typetag: tUPDATELEADER}
 	for {
-		req.newLeaderId, err = getCurrentLeader(conf)
-		if err != nil {
-			// in this case req.newLeaderId is ''
+		renewStart := time.Now()
+		newLeaderId, err := conf.backend.AcquireOrRenew(ctx, conf.selfId, conf.leaderHoldTime)
+		conf.metrics.RenewLatency(time.Since(renewStart))
+
+		if err == nil {
+			failingSince = time.Time{}
+		} else {
 			log.Printf("State Updater: unable to determine current leader: '%s'\n", err.Error())
+
+			if lastLeaderId == conf.selfId && conf.renewBehavior == IgnoreTransient {
+				if failingSince.IsZero() {
+					failingSince = time.Now()
+				}
+				if time.Since(failingSince) < conf.renewGrace {
+					// a transient renewal error, keep the lease we already hold
+					if !sleepOrDone(ctx, jittered(conf.renewInterval)) {
+						return
+					}
+					continue
+				}
+			}
+
+			// in this case newLeaderId is ''
+			newLeaderId = ""
+		}
+
+		if newLeaderId != lastLeaderId {
+			req := request{typetag: tUPDATELEADER, newLeaderId: newLeaderId}
+			select {
+			case updch <- req:
+				lastLeaderId = newLeaderId
+			case <-ctx.Done():
+				return
+			}
 		}
 
-		if req.newLeaderId != lastLeaderId {
-			updch <- req
-			lastLeaderId = req.newLeaderId
+		interval := conf.leaderHoldTime / 3
+		if lastLeaderId == conf.selfId {
+			interval = conf.renewInterval
+		}
+		if !sleepOrDone(ctx, jittered(interval)) {
+			return
 		}
+	}
+}
 
-		// the random part guarantees that all the peers will not send requests to Consul simultaneously
-		time.Sleep((conf.leaderHoldTime / 3) + time.Duration(rand.Intn(1000))*time.Millisecond)
+// jittered adds up to a second of random jitter to d, so peers sharing the
+// same interval don't all hit the backend simultaneously.
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Intn(1000))*time.Millisecond
+}
+
+// sleepOrDone sleeps for d, returning false early if ctx is done first.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
 }
 
-// Create an instance of the elector.
-func Create(selfId, consulUrl string, leaderHoldTime time.Duration) (inst *Instance, err error) {
+// Create an instance of the elector backed by the given Backend.
+func Create(selfId string, backend Backend, leaderHoldTime time.Duration, opts ...Option) (inst *Instance, err error) {
+	return CreateWithContext(context.Background(), selfId, backend, leaderHoldTime, opts...)
+}
+
+// CreateWithContext is like Create, but the elector's two background
+// goroutines are tied to ctx instead of context.Background(): cancelling ctx
+// has the same effect as calling Instance.Close().
+func CreateWithContext(ctx context.Context, selfId string, backend Backend, leaderHoldTime time.Duration, opts ...Option) (inst *Instance, err error) {
 	if selfId == "" {
 		err := fmt.Errorf("selfId should be a non-empty string")
 		return nil, err
 	}
 
+	if backend == nil {
+		err := fmt.Errorf("backend should not be nil")
+		return nil, err
+	}
+
 	if leaderHoldTime <= 0 {
 		err := fmt.Errorf("leaderHoldTime should be greater than zero")
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	reqch := make(chan request)
-	conf := &electorConfig{selfId: selfId, consulUrl: consulUrl, leaderHoldTime: leaderHoldTime}
-	go stateKeeperProc(reqch)
-	go stateUpdaterProc(conf, reqch)
-	return &Instance{reqch: reqch}, nil
+	conf := &electorConfig{
+		selfId:          selfId,
+		backend:         backend,
+		leaderHoldTime:  leaderHoldTime,
+		renewInterval:   leaderHoldTime / 3,
+		renewGrace:      leaderHoldTime - leaderHoldTime/10,
+		renewBehavior:   ErrorOnFail,
+		metrics:         NopMetrics{},
+		callbackTimeout: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stateKeeperProc(ctx, conf, reqch)
+	}()
+	go func() {
+		defer wg.Done()
+		stateUpdaterProc(ctx, conf, reqch)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return &Instance{reqch: reqch, cancel: cancel, done: done}, nil
 }
 
-// Returns current leader id, or '' if leader is unknown.
+// Returns current leader id, or ” if leader is unknown.
 func (inst *Instance) GetCurrentLeader() (leaderid string) {
 	respch := make(chan string)
 	req := request{typetag: tGETLEADER, respch: respch}
-	inst.reqch <- req
-	resp := <-respch
-	return resp
+	select {
+	case inst.reqch <- req:
+	case <-inst.done:
+		return ""
+	}
+	select {
+	case resp := <-respch:
+		return resp
+	case <-inst.done:
+		return ""
+	}
 }
 
 // Registers a callback.
 func (inst *Instance) RegisterCallback(cb Callback) {
 	req := request{typetag: tREGCALLBACK, callback: cb}
-	inst.reqch <- req
+	select {
+	case inst.reqch <- req:
+	case <-inst.done:
+	}
+}
+
+// How often TransferLeadership polls GetCurrentLeader while waiting for the
+// handoff to take effect.
+const transferPollInterval = 100 * time.Millisecond
+
+// TransferLeadership asks this node, which must be the current leader, to
+// voluntarily step down in favor of targetId, then blocks until
+// GetCurrentLeader reports targetId or ctx is done. It refuses with an error
+// if this node isn't currently the leader.
+//
+// Not every Backend can force a specific node to win the next election (see
+// the Release method of the Backend in use), so this is a best-effort
+// handoff: useful for draining a node during a rolling deploy well ahead of
+// its lease expiring, rather than a hard guarantee that targetId ends up leading.
+func (inst *Instance) TransferLeadership(ctx context.Context, targetId string) error {
+	errch := make(chan error)
+	req := request{typetag: tTRANSFER, targetId: targetId, errch: errch}
+	select {
+	case inst.reqch <- req:
+	case <-inst.done:
+		return fmt.Errorf("elector: instance is closed")
+	}
+
+	select {
+	case err := <-errch:
+		if err != nil {
+			return err
+		}
+	case <-inst.done:
+		return fmt.Errorf("elector: instance is closed")
+	}
+
+	for inst.GetCurrentLeader() != targetId {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-inst.done:
+			return fmt.Errorf("elector: instance is closed")
+		case <-time.After(transferPollInterval):
+		}
+	}
+	return nil
+}
+
+// Close stops the elector: it cancels the elector's own context (derived
+// from the one passed to CreateWithContext, if any; the caller's context is
+// left as it is), fires a final callback stepping down to ” if this
+// node was the leader, and blocks until both of the elector's goroutines
+// have exited.
+func (inst *Instance) Close() {
+	inst.cancel()
+	<-inst.done
 }
@@ -0,0 +1,175 @@
+package elector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockBackend is an in-memory Backend used to exercise the elector without a
+// real Consul or etcd cluster. It is safe for the same kind of concurrent
+// use a real Backend must tolerate (AcquireOrRenew from the State Updater,
+// Release from the State Keeper).
+type mockBackend struct {
+	mu         sync.Mutex
+	leaderId   string
+	acquireErr error
+}
+
+func (b *mockBackend) AcquireOrRenew(ctx context.Context, selfId string, hold time.Duration) (leaderId string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.acquireErr != nil {
+		return "", b.acquireErr
+	}
+	if b.leaderId == "" {
+		b.leaderId = selfId
+	}
+	return b.leaderId, nil
+}
+
+func (b *mockBackend) Release(ctx context.Context, targetId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.leaderId = targetId
+	return nil
+}
+
+func (b *mockBackend) setAcquireErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.acquireErr = err
+}
+
+// awaitLeader polls GetCurrentLeader until it reports id or t fails.
+func awaitLeader(t *testing.T, inst *Instance, id string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for inst.GetCurrentLeader() != id {
+		if time.Now().After(deadline) {
+			t.Fatalf("GetCurrentLeader never reported '%s'", id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestCloseFiresFinalStepDownCallback checks that Close cancels the
+// background goroutines, leaves no later caller blocked on the request
+// channel, and - since this node was leader - fires one last
+// tUPDATELEADER(”) callback before returning.
+func TestCloseFiresFinalStepDownCallback(t *testing.T) {
+	backend := &mockBackend{}
+
+	inst, err := Create("node-a", backend, 50*time.Millisecond, WithRenewInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+
+	var mu sync.Mutex
+	var transitions [][2]string
+	inst.RegisterCallback(func(ctx context.Context, oldLeaderId, newLeaderId string) error {
+		mu.Lock()
+		transitions = append(transitions, [2]string{oldLeaderId, newLeaderId})
+		mu.Unlock()
+		return nil
+	})
+
+	awaitLeader(t, inst, "node-a", time.Second)
+
+	closed := make(chan struct{})
+	go func() {
+		inst.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close did not return in time, goroutines likely leaked")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(transitions) == 0 || transitions[len(transitions)-1] != ([2]string{"node-a", ""}) {
+		t.Fatalf("expected a final step-down callback to '', got %v", transitions)
+	}
+
+	if leaderId := inst.GetCurrentLeader(); leaderId != "" {
+		t.Fatalf("GetCurrentLeader after Close = '%s', want ''", leaderId)
+	}
+}
+
+// TestRenewGraceIgnoresTransientErrors checks that with RenewBehavior
+// IgnoreTransient, a leader keeps its lease through backend errors shorter
+// than RenewGrace, but still surrenders leadership once the grace window
+// runs out.
+func TestRenewGraceIgnoresTransientErrors(t *testing.T) {
+	backend := &mockBackend{}
+
+	inst, err := Create("node-a", backend, 200*time.Millisecond,
+		WithRenewInterval(10*time.Millisecond),
+		WithRenewGrace(60*time.Millisecond),
+		WithRenewBehavior(IgnoreTransient))
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	defer inst.Close()
+
+	awaitLeader(t, inst, "node-a", time.Second)
+
+	backend.setAcquireErr(errors.New("transient backend error"))
+
+	time.Sleep(30 * time.Millisecond)
+	if leaderId := inst.GetCurrentLeader(); leaderId != "node-a" {
+		t.Fatalf("GetCurrentLeader during grace window = '%s', want 'node-a'", leaderId)
+	}
+
+	// jittered() can add up to a second to each poll interval, so allow for
+	// a couple of slow polls rather than tying this to RenewGrace directly.
+	deadline := time.Now().Add(5 * time.Second)
+	for inst.GetCurrentLeader() != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("leadership was never surrendered after RenewGrace expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestTransferLeadership checks the handoff handshake: it refuses on a node
+// that isn't currently the leader, and on the leader it blocks until the
+// target is observed to hold leadership.
+func TestTransferLeadership(t *testing.T) {
+	backend := &mockBackend{}
+	// Keep node-a from winning leadership on the State Updater's first tick,
+	// so the refusal assertion below isn't racing it.
+	backend.setAcquireErr(errors.New("not primed yet"))
+
+	inst, err := Create("node-a", backend, 200*time.Millisecond, WithRenewInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	defer inst.Close()
+
+	if err := inst.TransferLeadership(context.Background(), "node-b"); err == nil {
+		t.Fatalf("TransferLeadership on a non-leader should have refused")
+	}
+
+	backend.setAcquireErr(nil)
+	awaitLeader(t, inst, "node-a", time.Second)
+
+	// jittered() can add up to a second to the State Updater's next poll
+	// interval, so give the handoff plenty of room to land.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := inst.TransferLeadership(ctx, "node-b"); err != nil {
+		t.Fatalf("TransferLeadership failed: %s", err)
+	}
+
+	if leaderId := inst.GetCurrentLeader(); leaderId != "node-b" {
+		t.Fatalf("GetCurrentLeader after transfer = '%s', want 'node-b'", leaderId)
+	}
+}
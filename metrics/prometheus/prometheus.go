@@ -0,0 +1,90 @@
+// Package prometheus implements elector.Metrics on top of a
+// prometheus.Registerer.
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/afiskon/go-elector"
+)
+
+// Metrics is a Prometheus backed implementation of elector.Metrics.
+type Metrics struct {
+	leaderTransitions *prometheus.CounterVec
+	casConflicts      prometheus.Counter
+	httpErrors        *prometheus.CounterVec
+	renewLatency      prometheus.Histogram
+	isLeader          *prometheus.GaugeVec
+}
+
+// New registers the elector's metrics with reg and returns a Metrics backed
+// by them. namespace/subsystem are passed through to every metric name, so
+// callers embedding more than one elector instance can tell them apart.
+func New(reg prometheus.Registerer, namespace, subsystem string) *Metrics {
+	m := &Metrics{
+		leaderTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "leader_transitions_total",
+			Help:      "Number of times the known leader changed.",
+		}, []string{"old_leader_id", "new_leader_id"}),
+		casConflicts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cas_conflicts_total",
+			Help:      "Number of times a compare-and-swap style write lost a race to another node.",
+		}),
+		httpErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "http_errors_total",
+			Help:      "Number of unexpected HTTP status codes received from the backend, by status code.",
+		}, []string{"status_code"}),
+		renewLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "renew_latency_seconds",
+			Help:      "Latency of a single AcquireOrRenew call against the backend.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		isLeader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "is_leader",
+			Help:      "1 if self_id currently believes it holds leadership, 0 otherwise.",
+		}, []string{"self_id"}),
+	}
+
+	reg.MustRegister(m.leaderTransitions, m.casConflicts, m.httpErrors, m.renewLatency, m.isLeader)
+	return m
+}
+
+func (m *Metrics) LeaderTransition(oldLeaderId, newLeaderId string) {
+	m.leaderTransitions.WithLabelValues(oldLeaderId, newLeaderId).Inc()
+}
+
+func (m *Metrics) CASConflict() {
+	m.casConflicts.Inc()
+}
+
+func (m *Metrics) HTTPError(statusCode int) {
+	m.httpErrors.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+}
+
+func (m *Metrics) RenewLatency(d time.Duration) {
+	m.renewLatency.Observe(d.Seconds())
+}
+
+func (m *Metrics) IsLeader(selfId string, isLeader bool) {
+	value := 0.0
+	if isLeader {
+		value = 1.0
+	}
+	m.isLeader.WithLabelValues(selfId).Set(value)
+}
+
+// compile-time check that Metrics satisfies elector.Metrics
+var _ elector.Metrics = (*Metrics)(nil)